@@ -1,141 +1,2249 @@
 #!/bin/bash
 
+config_file="${XDG_CONFIG_HOME:-$HOME/.config}/zig-installer/config.toml"
+state_dir="${XDG_STATE_HOME:-$HOME/.local/state}/zig-installer"
+log_file="${state_dir}/zig-install.log"
+log_format=text
+log_level=""
+console_log_level=""
+log_command=install
+cache_dir="${XDG_CACHE_HOME:-$HOME/.cache}/zig-installer"
+scratch_dir=""
+trace_http=false
+allow_unsafe_bin_dir=false
+skip_deps_check=false
+quiet=false
+verbose=false
+non_interactive=false
+assume_yes=false
+zls_prebuilt=false
+zls_version_override=""
+with_src=false
+wait_for_lock=false
+clean_temp=false
+desktop_notify=false
+prefix=""
+no_symlink=false
+installed_bin_dirs=()
+installed_zig_version=""
+channel=master
+zig_version_request=""
+zig_tarball_url=""
+keep_tarball=""
+versions_file=""
+link_zig=true
+zls_job=""
+print_path=false
+github_output=false
+progress=""
+purge=false
+purge_config=false
+clear_zig_cache=false
+index_key=master
+
+# Exit codes; see the "Exit Codes" section of the README
+EXIT_ERROR=1
+EXIT_VERSION_NOT_FOUND=2
+EXIT_VERIFICATION_FAILED=3
+EXIT_DOWNLOAD_FAILED=4
+EXIT_NO_SPACE=5
+EXIT_UNSAFE_BIN_DIR=6
+EXIT_BUILD_FAILED=7
+EXIT_USAGE=8
+EXIT_MISSING_DEPENDENCY=9
+EXIT_LOCKED=10
+EXIT_UNSUPPORTED_PLATFORM=11
+
+# Settings that can be set in the config file, as "key default" pairs
+settings=(
+	"zig_dir /opt/zig"
+	"zls_dir /opt/zls"
+	"zls_prebuilt_dir /opt/zls-prebuilt"
+	"bin_dir /usr/local/bin"
+	"manage_zls true"
+	"zig_index_url https://ziglang.org/download/index.json"
+	"zig_builds_url https://ziglang.org/builds"
+	"mach_index_url https://machengine.org/zig/index.json"
+	"mach_builds_url https://pkg.machengine.org/zig"
+	"zls_repo_url https://github.com/zigtools/zls.git"
+	"zls_release_url https://releases.zigtools.org/v1/zls/select-version"
+	"log_max_size 1M"
+	"log_max_age 30"
+	"log_keep 3"
+	"privilege_tool auto"
+	"git_timeout 300"
+	"build_timeout 1800"
+	"on_change "
+	"zls_public_key RWR+9B91GBZ0zOjh6Lr17+zKf5BoSuFvrx2xSeDE57uIYvnKBGmMjOex"
+	"zig_public_key RWSGOq2NVecA2UPNdBUZykf1CCb147pkmdtYxgb3Ti+JO/wCYvhbAb/U"
+	"cosign_key "
+	"http_retries 3"
+	"keep_tarball false"
+)
+
 # Help function to display usage information
 help() {
 	echo "Usage: $0 [OPTIONS]"
+	echo "       $0 config list|get KEY|set KEY VALUE|unset KEY"
+	echo "       $0 init"
+	echo "       $0 logs [--tail N] [--follow] [--log-file PATH]"
+	echo "       $0 setup-path [--shell bash|zsh|fish] [--remove]"
+	echo "       $0 env [--shell bash|zsh|fish|powershell]"
+	echo "       $0 changelog FROM TO"
+	echo "       $0 du [--json]"
 	echo "Install Zig and ZLS (Zig Language Server) or only one of them."
 	echo
 	echo "Options:"
 	echo "  --zig-only      Install only Zig"
 	echo "  --zls-only      Install only ZLS (Zig Language Server)"
+	echo "  --channel master|mach"
+	echo "                  Install the latest Zig master build (default) or the version nominated by Mach"
+	echo "  --version VERSION|URL"
+	echo "                  Install this exact Zig version (e.g. 0.14.0-dev.1234+abcdef) or tarball URL"
+	echo "  --from-versions-file FILE"
+	echo "                  Install every Zig version or tarball URL listed in FILE, linking the first one"
+	echo "  --print-path    Print the directory the selected Zig version is (or would be) installed in, and exit"
+	echo "  --keep-tarball  Keep the verified Zig tarball in ${cache_dir}/tarballs for reinstalls"
+	echo "  --with-src      Also install the Zig source tarball into the version directory"
+	echo "  --zls-prebuilt  Download the official prebuilt ZLS instead of building it from source"
+	echo "  --zls-version VERSION"
+	echo "                  Build this ZLS release or commit instead of the one matching the installed Zig"
+	echo "  --zls-status    Show the installed ZLS version and whether it matches the active Zig, then exit"
+	echo "  --uninstall-zls Remove ZLS (sources, builds and the zls link) and exit"
+	echo "  --purge         Remove everything the installer manages (Zig, ZLS, links, cache, logs) and exit"
+	echo "  --with-config   With --purge, also remove the config file"
+	echo "  --trace-http    Log every HTTP request and response to ${log_file}"
+	echo "  --log-file PATH Write the log to PATH instead of ${log_file}"
+	echo "  --log-level debug|info|warn|error"
+	echo "                  Minimum level written to the log file (default: info, or debug with --trace-http)"
+	echo "  --console-log-level debug|info|warn|error"
+	echo "                  Also write log entries at or above this level to standard error"
+	echo "  --log-format text|json"
+	echo "                  Write log entries as text lines (default) or one JSON object per line"
+	echo "  --skip-deps-check"
+	echo "                  Do not check that required tools are installed before starting"
+	echo "  --prefix DIR    Install everything under DIR (DIR/zig, DIR/zls, ...), with links in DIR/bin"
+	echo "  --no-symlink    Do not create zig/zls links; print the directories to add to PATH instead"
+	echo "  --allow-unsafe-bin-dir"
+	echo "                  Create links in the bin directory even if it is world-writable or owned by another user"
+	echo "  --github-output Add Zig to GITHUB_PATH, set version and path outputs and fold logs in GitHub Actions"
+	echo "  --progress json Write progress events (phase, percent, bytes, message) to stderr as JSON lines"
+	echo "  -q, --quiet     Only print warnings and errors"
+	echo "  -v, --verbose   Show every external command with its exit code and duration"
+	echo "  --clean-temp    Remove temporary files left behind by interrupted runs and exit"
+	echo "  --clear-zig-cache"
+	echo "                  Remove Zig's global build cache after confirmation and exit"
+	echo "  -y, --yes       Answer yes to every confirmation prompt"
+	echo "  --non-interactive"
+	echo "                  Never prompt; answer every question with its default"
+	echo "  --notify        Show a desktop notification when the install finishes or fails"
+	echo "  --wait          Wait for another running instance to finish instead of exiting"
 	echo "  -h, --help      Display this help message and exit"
-	exit 0
+	exit "${1:-0}"
+}
+
+# Read flat `key = value` lines of the TOML config file into config_<key> variables
+load_config() {
+	if [[ ! -f "${config_file}" ]]; then
+		return 0
+	fi
+
+	local line key value
+	while IFS= read -r line || [[ -n "${line}" ]]; do
+		if [[ "${line}" =~ ^[[:space:]]*(#.*)?$ ]]; then
+			continue
+		elif [[ ! "${line}" =~ ^[[:space:]]*([a-z_]+)[[:space:]]*=[[:space:]]*(.*[^[:space:]])[[:space:]]*$ ]]; then
+			echo "Warning: ignoring malformed line in ${config_file}: ${line}" >&2
+			continue
+		fi
+
+		key=${BASH_REMATCH[1]}
+		value=${BASH_REMATCH[2]}
+		if [[ "${value}" == \"*\" ]]; then
+			value=${value:1:-1}
+		fi
+
+		if is_setting "${key}"; then
+			printf -v "config_${key}" '%s' "${value}"
+		else
+			echo "Warning: unknown setting '${key}' in ${config_file}." >&2
+		fi
+	done <"${config_file}"
+}
+
+# Succeed when the given key names a known setting
+is_setting() {
+	for entry in "${settings[@]}"; do
+		if [[ "${entry%% *}" == "$1" ]]; then
+			return 0
+		fi
+	done
+	return 1
+}
+
+# Print a setting from its ZIG_INSTALL_* environment variable, the config file, or its default
+setting() {
+	local key=$1 env_name="ZIG_INSTALL_${1^^}" config_name="config_$1"
+
+	if [[ -n "${!env_name+set}" ]]; then
+		echo "${!env_name}"
+	elif [[ -n "${!config_name+set}" ]]; then
+		echo "${!config_name}"
+	else
+		for entry in "${settings[@]}"; do
+			if [[ "${entry%% *}" == "${key}" ]]; then
+				echo "${entry#* }"
+			fi
+		done
+	fi
+}
+
+# Print where a setting's value comes from: env, config or default
+setting_source() {
+	local env_name="ZIG_INSTALL_${1^^}" config_name="config_$1"
+
+	if [[ -n "${!env_name+set}" ]]; then
+		echo "env"
+	elif [[ -n "${!config_name+set}" ]]; then
+		echo "config"
+	else
+		echo "default"
+	fi
+}
+
+# Rewrite the config file without the given key
+remove_config_key() {
+	if [[ -f "${config_file}" ]]; then
+		grep -v -E "^[[:space:]]*$1[[:space:]]*=" "${config_file}" >"${config_file}.tmp"
+		mv "${config_file}.tmp" "${config_file}"
+	fi
+}
+
+# Read and persist values in the config file
+config_command() {
+	local action=$1 key=$2
+
+	if [[ "${action}" =~ ^(get|set|unset)$ ]] && ! is_setting "${key}"; then
+		echo "Unknown setting '${key}'. Run $0 config list to see all settings."
+		exit "${EXIT_USAGE}"
+	fi
+
+	load_config
+	case "${action}" in
+	list)
+		for entry in "${settings[@]}"; do
+			key=${entry%% *}
+			echo "${key} = $(setting "${key}") ($(setting_source "${key}"))"
+		done
+		;;
+	get)
+		setting "${key}"
+		;;
+	set)
+		if [[ "$#" -ne 3 ]]; then
+			echo "Usage: $0 config set KEY VALUE"
+			exit "${EXIT_USAGE}"
+		fi
+		mkdir -p "$(dirname "${config_file}")"
+		remove_config_key "${key}"
+		echo "${key} = \"$3\"" >>"${config_file}"
+		info "Set ${key} in ${config_file}."
+		;;
+	unset)
+		remove_config_key "${key}"
+		info "Unset ${key} in ${config_file}."
+		;;
+	*)
+		echo "Usage: $0 config list|get KEY|set KEY VALUE|unset KEY"
+		exit "${EXIT_USAGE}"
+		;;
+	esac
+}
+
+# Walk through first-time setup and write the answers to the config file
+init_command() {
+	load_config
+	if [[ -f "${config_file}" ]] && ! confirm "${config_file} already exists. Overwrite it?"; then
+		exit 0
+	fi
+
+	zig_dir=$(ask "Directory to install Zig versions into" "$(setting zig_dir)")
+	zls_dir=$(ask "Directory to build ZLS in" "$(setting zls_dir)")
+	bin_dir=$(ask "Directory for the zig and zls links" "$(setting bin_dir)")
+	if confirm "Install and update ZLS along with Zig?" "$(setting manage_zls)"; then
+		manage_zls=true
+	else
+		manage_zls=false
+	fi
+
+	mkdir -p "$(dirname "${config_file}")"
+	{
+		echo "# Written by $0 init"
+		echo "zig_dir = \"${zig_dir}\""
+		echo "zls_dir = \"${zls_dir}\""
+		echo "bin_dir = \"${bin_dir}\""
+		echo "manage_zls = ${manage_zls}"
+	} >"${config_file}"
+	echo "Wrote ${config_file}."
+
+	if [[ ":${PATH}:" != *":${bin_dir}:"* ]]; then
+		echo "${bin_dir} is not in your PATH; run $0 setup-path to add it, or add this line to your shell's startup file:"
+		echo "  export PATH=\"${bin_dir}:\$PATH\""
+	fi
+}
+
+# Add the bin directory to PATH in the startup file of the user's shell, or remove it again
+setup_path_command() {
+	shell=$(basename "${SHELL:-bash}")
+	remove=false
+	while [[ "$#" -gt 0 ]]; do
+		case "$1" in
+		--shell)
+			shell=$2
+			shift
+			;;
+		--remove) remove=true ;;
+		*)
+			echo "Usage: $0 setup-path [--shell bash|zsh|fish] [--remove]"
+			exit "${EXIT_USAGE}"
+			;;
+		esac
+		shift
+	done
+
+	case "${shell}" in
+	bash) rc_file="${HOME}/.bashrc" ;;
+	zsh) rc_file="${ZDOTDIR:-$HOME}/.zshrc" ;;
+	fish) rc_file="${XDG_CONFIG_HOME:-$HOME/.config}/fish/config.fish" ;;
+	*)
+		echo "Unsupported shell '${shell}'; use --shell bash, zsh or fish."
+		exit "${EXIT_USAGE}"
+		;;
+	esac
+
+	load_settings
+	begin_marker="# >>> zig-installer PATH >>>"
+	end_marker="# <<< zig-installer PATH <<<"
+	# Drop any block written earlier, so running the command again updates it in place.
+	if [[ -f "${rc_file}" ]] && grep -qF "${begin_marker}" "${rc_file}"; then
+		sed "\|^${begin_marker}\$|,\|^${end_marker}\$|d" "${rc_file}" >"${rc_file}.tmp"
+		cat "${rc_file}.tmp" >"${rc_file}"
+		rm -f "${rc_file}.tmp"
+		if [[ "${remove}" == true ]]; then
+			info "Removed the PATH setup from ${rc_file}."
+			return
+		fi
+	elif [[ "${remove}" == true ]]; then
+		info "${rc_file} has no PATH setup from this script."
+		return
+	fi
+
+	mkdir -p "$(dirname "${rc_file}")"
+	{
+		echo "${begin_marker}"
+		echo "# Added by $0 setup-path; remove with $0 setup-path --remove"
+		path_snippet "${shell}"
+		echo "${end_marker}"
+	} >>"${rc_file}"
+	info "Added ${bin_dir} to PATH in ${rc_file}; open a new shell for it to take effect."
+}
+
+# Print only the PATH setup for the given shell, for use with eval or source
+env_command() {
+	shell=$(basename "${SHELL:-bash}")
+	while [[ "$#" -gt 0 ]]; do
+		case "$1" in
+		--shell)
+			shell=$2
+			shift
+			;;
+		*)
+			echo "Usage: $0 env [--shell bash|zsh|fish|powershell]" >&2
+			exit "${EXIT_USAGE}"
+			;;
+		esac
+		shift
+	done
+
+	if [[ ! "${shell}" =~ ^(bash|zsh|fish|powershell|pwsh)$ ]]; then
+		echo "Unsupported shell '${shell}'; use --shell bash, zsh, fish or powershell." >&2
+		exit "${EXIT_USAGE}"
+	fi
+	load_settings
+	path_snippet "${shell}"
+}
+
+# List the Zig releases after FROM up to and including TO, with links to their release notes
+changelog_command() {
+	if [[ "$#" -ne 2 ]]; then
+		echo "Usage: $0 changelog FROM TO"
+		exit "${EXIT_USAGE}"
+	fi
+	from=$1
+	to=$2
+
+	load_settings
+	if ! index=$(http -qO- "${zig_index_url}"); then
+		error "Failed to fetch the Zig download index."
+		report_upstream_status "${zig_index_url}"
+		exit "${EXIT_DOWNLOAD_FAILED}"
+	fi
+	for release in "${from}" "${to}"; do
+		if [[ "$(jq -r --arg release "${release}" 'has($release)' <<<"${index}")" != true ]]; then
+			error "Zig ${release} is not a release listed in ${zig_index_url}."
+			exit "${EXIT_VERSION_NOT_FOUND}"
+		fi
+	done
+
+	releases=$(jq -r 'keys[] | select(. != "master")' <<<"${index}" | sort -V)
+	found=false
+	while IFS= read -r release; do
+		# Releases sort in version order, so everything after FROM up to TO is in range.
+		if [[ "$(printf '%s\n' "${from}" "${release}" | sort -V | tail -n 1)" != "${release}" || "${release}" == "${from}" ]]; then
+			continue
+		elif [[ "$(printf '%s\n' "${release}" "${to}" | sort -V | tail -n 1)" != "${to}" ]]; then
+			break
+		fi
+		found=true
+		jq -r --arg release "${release}" \
+			'.[$release] | "\($release) (\(.date // "unknown date")): \(.notes // "no release notes published")"' <<<"${index}"
+	done <<<"${releases}"
+
+	if [[ "${found}" != true ]]; then
+		echo "No releases after ${from} up to ${to}."
+	fi
+}
+
+# Show how much disk space Zig versions, ZLS, caches and logs use
+du_command() {
+	json=false
+	if [[ "$1" == --json ]]; then
+		json=true
+	elif [[ "$#" -gt 0 ]]; then
+		echo "Usage: $0 du [--json]"
+		exit "${EXIT_USAGE}"
+	fi
+
+	load_settings
+	names=()
+	paths=()
+	for dir in "${zig_dir}"/zig-linux-x86_64-*/; do
+		if [[ -d "${dir}" ]]; then
+			dir=${dir%/}
+			names+=("Zig ${dir##*/zig-linux-x86_64-}")
+			paths+=("${dir}")
+		fi
+	done
+	names+=("ZLS source and build" "Prebuilt ZLS" "Download cache" "Zig global cache" "Logs")
+	paths+=("${zls_dir}" "${zls_prebuilt_dir}" "${cache_dir}" "$(zig_global_cache_dir)" "${log_file}")
+
+	entries=""
+	total=0
+	for i in "${!paths[@]}"; do
+		bytes=0
+		if [[ "${names[i]}" == Logs ]]; then
+			for file in "${log_file}" "${log_file}".[0-9]*; do
+				if [[ -f "${file}" ]]; then
+					bytes=$((bytes + $(stat -c %s "${file}")))
+				fi
+			done
+		elif [[ -e "${paths[i]}" ]]; then
+			bytes=$(du -sb "${paths[i]}" 2>/dev/null | cut -f 1)
+		fi
+		total=$((total + bytes))
+		entries+="${names[i]}"$'\t'"${paths[i]}"$'\t'"${bytes}"$'\n'
+	done
+
+	if [[ "${json}" == true ]]; then
+		jq -R -s --argjson total "${total}" \
+			'{entries: [split("\n")[] | select(. != "") | split("\t") | {name: .[0], path: .[1], bytes: (.[2] | tonumber)}], total: $total}' <<<"${entries}"
+		return
+	fi
+	while IFS=$'\t' read -r name path bytes; do
+		if [[ -n "${name}" ]]; then
+			printf '%8s  %-22s %s\n' "$(numfmt --to=iec "${bytes}")" "${name}" "${path}"
+		fi
+	done <<<"${entries}"
+	printf '%8s  %s\n' "$(numfmt --to=iec "${total}")" "Total"
+}
+
+# Print the line that puts the bin directory first on PATH, in the given shell's syntax
+path_snippet() {
+	case "$1" in
+	fish) echo "fish_add_path --prepend \"${bin_dir}\"" ;;
+	powershell | pwsh) echo "\$env:PATH = \"${bin_dir}\" + [IO.Path]::PathSeparator + \$env:PATH" ;;
+	*) echo "export PATH=\"${bin_dir}:\$PATH\"" ;;
+	esac
+}
+
+# Print or follow the log file
+logs_command() {
+	lines=50
+	follow=()
+	while [[ "$#" -gt 0 ]]; do
+		case "$1" in
+		--tail)
+			if [[ ! "$2" =~ ^[0-9]+$ ]]; then
+				echo "--tail requires a number of lines."
+				exit "${EXIT_USAGE}"
+			fi
+			lines=$2
+			shift
+			;;
+		--follow | -f) follow=(--follow=name --retry) ;;
+		--log-file)
+			log_file=$2
+			shift
+			;;
+		*)
+			echo "Usage: $0 logs [--tail N] [--follow] [--log-file PATH]"
+			exit "${EXIT_USAGE}"
+			;;
+		esac
+		shift
+	done
+
+	if [[ ! -f "${log_file}" && "${#follow[@]}" -eq 0 ]]; then
+		echo "No log file at ${log_file} yet."
+		return
+	fi
+	echo "==> ${log_file} <=="
+	tail -n "${lines}" "${follow[@]}" "${log_file}"
+}
+
+# Resolve every setting once the command line and config file have been read
+load_settings() {
+	load_config
+	zig_dir=$(setting zig_dir)
+	zls_dir=$(setting zls_dir)
+	zls_prebuilt_dir=$(setting zls_prebuilt_dir)
+	bin_dir=$(setting bin_dir)
+	manage_zls=$(setting manage_zls)
+	zig_index_url=$(setting zig_index_url)
+	zig_builds_url=$(setting zig_builds_url)
+	mach_index_url=$(setting mach_index_url)
+	mach_builds_url=$(setting mach_builds_url)
+	zls_repo_url=$(setting zls_repo_url)
+	zls_release_url=$(setting zls_release_url)
+	log_max_size=$(setting log_max_size)
+	log_max_age=$(setting log_max_age)
+	log_keep=$(setting log_keep)
+	privilege_tool=$(setting privilege_tool)
+	git_timeout=$(setting git_timeout)
+	build_timeout=$(setting build_timeout)
+	on_change_command=$(setting on_change)
+	zls_public_key=$(setting zls_public_key)
+	zig_public_key=$(setting zig_public_key)
+	cosign_key=$(setting cosign_key)
+	http_retries=$(setting http_retries)
+	keep_tarball=${keep_tarball:-$(setting keep_tarball)}
+}
+
+# Print the path of the Zig managed by this script, falling back to the one on PATH. Without
+# links that is the version this run installed, or else the newest installed version.
+zig_path() {
+	if [[ "${no_symlink}" == true && -x "${zig_dir}/zig-linux-x86_64-${installed_zig_version}/zig" ]]; then
+		echo "${zig_dir}/zig-linux-x86_64-${installed_zig_version}/zig"
+		return
+	elif [[ "${no_symlink}" == true ]]; then
+		newest=$(find "${zig_dir}" -mindepth 1 -maxdepth 1 -type d -name 'zig-linux-x86_64-*' 2>/dev/null | sort -V | tail -n 1)
+		if [[ -x "${newest}/zig" ]]; then
+			echo "${newest}/zig"
+			return
+		fi
+	fi
+	if [[ -x "${bin_dir}/zig" ]]; then
+		echo "${bin_dir}/zig"
+	else
+		command -v zig
+	fi
+}
+
+# Allocate this run's scratch directory for downloads and other temporary files
+make_scratch_dir() {
+	mkdir -p "${cache_dir}/tmp"
+	scratch_dir=$(mktemp -d "${cache_dir}/tmp/run.XXXXXX")
+	trap finish_run EXIT
+	trap 'exit 130' INT
+	trap 'exit 143' TERM
+}
+
+# Take the lock that keeps two runs from changing the installation at the same time
+acquire_lock() {
+	if ! command -v flock >/dev/null; then
+		warn "flock is not installed; not guarding against concurrent runs."
+		return 0
+	fi
+
+	# Spawned commands close fd 9 (see run), so only this process holds the lock.
+	mkdir -p "${state_dir}"
+	exec 9>"${state_dir}/zig-install.lock"
+	if flock -n 9; then
+		return 0
+	fi
+	if [[ "${wait_for_lock}" != true ]]; then
+		error "Another instance of the installer is running; try again later or use --wait."
+		exit "${EXIT_LOCKED}"
+	fi
+	info "Waiting for another instance of the installer to finish."
+	flock 9
+}
+
+# Clean up and report the outcome of the run; runs on exit, error and signals
+finish_run() {
+	code=$?
+	# Stop a background ZLS fetch when the Zig install is cancelled or fails.
+	if [[ -n "${zls_job}" ]]; then
+		kill_tree "${zls_job}"
+	fi
+	remove_scratch_dir
+	if [[ "${desktop_notify}" != true || "${log_command}" != install ]]; then
+		return
+	fi
+	if [[ "${code}" -eq 0 ]]; then
+		send_notification "Zig installer" "Installation finished."
+	else
+		send_notification "Zig installer" "Installation failed (exit code ${code}); see ${log_file}."
+	fi
+}
+
+# Terminate a process and everything it started. timeout moves its command into a process group of
+# its own, so signalling the job's process group would miss it. Each process is stopped before its
+# children are collected, so it cannot start new ones in the meantime.
+kill_tree() {
+	kill -STOP "$1" 2>/dev/null
+	for child in $(pgrep -P "$1"); do
+		kill_tree "${child}"
+	done
+	kill -TERM "$1" 2>/dev/null
+	kill -CONT "$1" 2>/dev/null
+}
+
+# Show a desktop notification with notify-send
+send_notification() {
+	if command -v notify-send >/dev/null; then
+		notify-send "$1" "$2" 2>/dev/null
+	else
+		log_entry warn "No notify-send found; cannot show a desktop notification."
+	fi
+}
+
+# Remove this run's scratch directory
+remove_scratch_dir() {
+	if [[ -n "${scratch_dir}" ]]; then
+		rm -rf "${scratch_dir}"
+	fi
+}
+
+# Print a progress message unless --quiet was given
+info() {
+	log_entry info "$*"
+	progress_event "${FUNCNAME[1]:-main}" "$*"
+	if [[ "${quiet}" != true ]]; then
+		echo "$@"
+	fi
+}
+
+# Print and log a warning, with optional multi-line details
+warn() {
+	log_entry warn "$1" "$2"
+	echo "Warning: $1"
+	if [[ -n "$2" ]]; then
+		echo "$2"
+	fi
+}
+
+# Print and log an error, with optional multi-line details
+error() {
+	log_entry error "$1" "$2"
+	echo "$1"
+	if [[ -n "$2" ]]; then
+		echo "$2"
+	fi
+}
+
+# Start a new log file once the current one is too large or too old, keeping log_keep old files
+rotate_log() {
+	if [[ ! -f "${log_file}" ]]; then
+		return 0
+	fi
+
+	max_bytes=$(numfmt --from=iec "${log_max_size}")
+	if [[ "$(stat -c %s "${log_file}")" -lt "${max_bytes}" && -z "$(find "${log_file}" -mtime +"${log_max_age}")" ]]; then
+		return 0
+	fi
+
+	rm -f "${log_file}.${log_keep}"
+	for ((i = log_keep - 1; i >= 1; i--)); do
+		if [[ -f "${log_file}.${i}" ]]; then
+			mv "${log_file}.${i}" "${log_file}.$((i + 1))"
+		fi
+	done
+	if [[ "${log_keep}" -gt 0 ]]; then
+		mv "${log_file}" "${log_file}.1"
+	else
+		rm -f "${log_file}"
+	fi
+}
+
+# Print the numeric severity of a log level
+log_severity() {
+	case "$1" in
+	debug) echo 0 ;;
+	info) echo 1 ;;
+	warn) echo 2 ;;
+	error) echo 3 ;;
+	esac
+}
+
+# Append an entry to each log destination whose level it meets: the log file (--log-level)
+# and standard error (--console-log-level)
+log_entry() {
+	level=$1
+	message=$2
+	details=$3
+	severity=$(log_severity "${level}")
+	to_file=false
+	to_console=false
+	if [[ -n "${log_level}" && "${severity}" -ge "$(log_severity "${log_level}")" ]]; then
+		to_file=true
+	fi
+	if [[ -n "${console_log_level}" && "${severity}" -ge "$(log_severity "${console_log_level}")" ]]; then
+		to_console=true
+	fi
+	if [[ "${to_file}" != true && "${to_console}" != true ]]; then
+		return 0
+	fi
+
+	timestamp=$(date '+%Y-%m-%dT%H:%M:%S%z')
+	step="${FUNCNAME[2]:-main}"
+	if [[ "${log_format}" == json ]]; then
+		entry=$(jq -nc --arg timestamp "${timestamp}" --arg level "${level}" --arg command "${log_command}" \
+			--arg step "${step}" --arg message "${message}" --arg details "${details}" \
+			'{timestamp: $timestamp, level: $level, command: $command, step: $step, message: $message}
+			+ if $details == "" then {} else {details: ($details | split("\n"))} end')
+	else
+		entry="${timestamp} [${level^^}] ${message}"
+		if [[ -n "${details}" ]]; then
+			entry+=$'\n'$(sed 's/^/    /' <<<"${details}")
+		fi
+	fi
+
+	if [[ "${to_file}" == true ]]; then
+		mkdir -p "$(dirname "${log_file}")"
+		echo "${entry}" >>"${log_file}"
+	fi
+	if [[ "${to_console}" == true ]]; then
+		echo "${entry}" >&2
+	fi
+}
+
+# Write a --progress json event to standard error
+progress_event() {
+	if [[ "${progress}" == json ]]; then
+		jq -nc --arg phase "$1" --arg message "$2" '{phase: $phase, message: $message}' >&2
+	fi
+}
+
+# Turn wget's dot progress (one line per 3M with --progress=dot:mega) into --progress json events,
+# writing wget's other output to the given file
+download_progress_events() {
+	awk -v url="$1" -v other="$2" '
+		BEGIN { gsub(/["\\]/, "\\\\&", url) }
+		!/^ *[0-9]+K[ .]+[0-9]+%/ {
+			print > other
+			next
+		}
+		{
+			dots = 0
+			for (i = 2; i <= NF && $i ~ /^\.+$/; i++) {
+				dots += length($i)
+			}
+			percent = $i
+			sub(/%$/, "", percent)
+			bytes = ($1 + 0) * 1024 + dots * 65536
+			printf "{\"phase\":\"download\",\"percent\":%d,\"bytes\":%d,\"message\":\"%s\"}\n", percent, bytes, url
+			fflush()
+		}' >&2
+}
+
+# Run wget, retrying when the server rate-limits the request with a Retry-After header
+http() {
+	local attempt=1 code delay
+	while true; do
+		http_request "$@"
+		code=$?
+		# wget exits with 8 when the server answered with an error status.
+		if [[ "${code}" -ne 8 || "${attempt}" -gt "${http_retries:-3}" ]]; then
+			return "${code}"
+		fi
+		delay=$(retry_after "${*: -1}")
+		if [[ -z "${delay}" ]]; then
+			return "${code}"
+		fi
+		warn "${*: -1} is rate-limited or unavailable; retrying in ${delay}s (retry ${attempt} of ${http_retries:-3})." >&2
+		sleep "${delay}"
+		attempt=$((attempt + 1))
+	done
+}
+
+# Print how many seconds a 429 or 503 response for the URL asks clients to wait, capped at five
+# minutes, or 0 once the URL is available again; prints nothing when retrying would not help
+retry_after() {
+	local headers status value seconds
+	headers=$(wget -q --server-response --spider "$1" 2>&1 9>&-)
+	status=$(awk '/^  HTTP\// { status = $2 } END { print status }' <<<"${headers}")
+	if [[ "${status}" == 2* ]]; then
+		echo 0
+		return
+	elif [[ "${status}" != 429 && "${status}" != 503 ]]; then
+		return
+	fi
+
+	value=$(awk 'tolower($1) == "retry-after:" { $1 = ""; sub(/^ /, ""); value = $0 } END { print value }' <<<"${headers}")
+	value=${value%$'\r'}
+	if [[ "${value}" =~ ^[0-9]+$ ]]; then
+		seconds=${value}
+	elif seconds=$(date -d "${value}" +%s 2>/dev/null); then
+		seconds=$((seconds - $(date +%s)))
+	else
+		return
+	fi
+	if [[ "${seconds}" -lt 1 ]]; then
+		seconds=1
+	elif [[ "${seconds}" -gt 300 ]]; then
+		seconds=300
+	fi
+	echo "${seconds}"
+}
+
+# Run wget once, recording the request in the log file when --trace-http is set
+http_request() {
+	local progress_events=false
+	if [[ "$1" == --progress-events ]]; then
+		progress_events=true
+		shift
+	fi
+	if [[ "${progress_events}" == true && "${trace_http}" != true ]]; then
+		# Only events may reach standard error, so wget's messages are kept for a failed download.
+		local output code
+		output=$(mktemp -p "${scratch_dir}")
+		{ wget --progress=dot:mega "$@" 2>&1 >&3 9>&- | download_progress_events "${*: -1}" "${output}"; } 3>&1
+		code=${PIPESTATUS[0]}
+		if [[ "${code}" -ne 0 ]]; then
+			warn "wget failed for ${*: -1}." "$(sed -e '/^$/d' -e 's/^ *//' "${output}")"
+		fi
+		rm -f "${output}"
+		return "${code}"
+	fi
+	if [[ "${trace_http}" != true ]]; then
+		wget "$@" 9>&-
+		return
+	fi
+
+	local args=() method="GET" url host ip trace start elapsed status code
+	for arg in "$@"; do
+		case "${arg}" in
+		-q) continue ;;
+		--spider) method="HEAD" ;;
+		esac
+		args+=("${arg}")
+	done
+	url="${*: -1}"
+	host="${url#*://}"
+	host="${host%%/*}"
+	ip=$(getent ahosts "${host}" | awk 'NR == 1 { print $1 }')
+
+	# Headers only: wget writes bodies to the output file, never to the trace.
+	trace=$(mktemp -p "${scratch_dir}")
+	start=$(date +%s%N)
+	if [[ "${progress_events}" == true ]]; then
+		{ wget --progress=dot:mega --server-response "${args[@]}" 2>&1 >&3 9>&- | download_progress_events "${url}" "${trace}"; } 3>&1
+		code=${PIPESTATUS[0]}
+	else
+		wget --no-verbose --server-response "${args[@]}" 2>"${trace}" 9>&-
+		code=$?
+	fi
+	elapsed=$((($(date +%s%N) - start) / 1000000))
+	status=$(awk '/^  HTTP\// { printf "%s%s", sep, $2; sep = " -> " }' "${trace}")
+
+	log_entry debug "http: ${method} ${url} ip=${ip:-unresolved} status=${status:-none} time=${elapsed}ms exit=${code}" "$(sed 's/^ *//' "${trace}")"
+	rm -f "${trace}"
+	return "${code}"
+}
+
+# Run an external command, logging its argv, exit code and duration (and showing them with --verbose)
+run() {
+	argv=$(printf '%q ' "$@")
+	argv=${argv% }
+	if [[ "${verbose}" == true ]]; then
+		echo "+ ${argv}" >&2
+	fi
+
+	start=$(date +%s%N)
+	# Commands must not inherit the run lock (see acquire_lock), or a process they leave behind keeps it.
+	"$@" 9>&-
+	code=$?
+	elapsed=$((($(date +%s%N) - start) / 1000000))
+
+	log_entry info "exec: ${argv} (exit ${code}, ${elapsed}ms)"
+	if [[ "${verbose}" == true ]]; then
+		echo "+ exit ${code} after ${elapsed}ms" >&2
+	fi
+	return "${code}"
+}
+
+# Print the command used to gain root privileges: sudo or doas, or nothing when already root
+escalation_tool() {
+	if [[ "$(id -u)" -eq 0 ]]; then
+		return 0
+	elif [[ "${privilege_tool}" != auto ]]; then
+		echo "${privilege_tool}"
+	elif command -v sudo >/dev/null; then
+		echo sudo
+	elif command -v doas >/dev/null; then
+		echo doas
+	fi
+}
+
+# Run a single command as root, telling the user exactly what will run before any password prompt
+escalate() {
+	if [[ "$(id -u)" -eq 0 ]]; then
+		run "$@"
+		return
+	fi
+
+	tool=$(escalation_tool)
+	if [[ -z "${tool}" ]] || ! command -v "${tool}" >/dev/null; then
+		error "Root privileges are needed to run '$*', but ${tool:-sudo or doas} is not available."
+		exit "${EXIT_ERROR}"
+	fi
+
+	echo "Running with ${tool}: $(printf '%q ' "$@")"
+	run "${tool}" "$@"
+}
+
+# Run a command that changes PATH, elevating only when PATH (or its nearest existing
+# parent) is not writable by the current user
+privileged() {
+	path=$1
+	shift
+
+	while [[ ! -e "${path}" && ! -L "${path}" ]]; do
+		path=$(dirname "${path}")
+	done
+	if [[ -L "${path}" || ! -d "${path}" ]]; then
+		path=$(dirname "${path}")
+	fi
+
+	if [[ -w "${path}" ]]; then
+		run "$@"
+	else
+		escalate "$@"
+	fi
+}
+
+# Create a directory owned by the current user, elevating only if its parent is not writable
+make_owned_dir() {
+	dir=$1
+
+	if [[ -d "${dir}" ]] || mkdir -p "${dir}" 2>/dev/null; then
+		return 0
+	fi
+	# Numeric IDs work even when no group is named after the user.
+	escalate install -d -o "$(id -u)" -g "$(id -g)" "${dir}"
+}
+
+# Run a command, killing it if it takes longer than the given number of seconds
+run_with_timeout() {
+	limit=$1
+	shift
+
+	run timeout "${limit}" "$@"
+	code=$?
+	if [[ "${code}" -eq 124 ]]; then
+		echo "'$*' timed out after ${limit}s; partial output is shown above."
+	fi
+	return "${code}"
+}
+
+# Check whether the given upstream URLs respond, so outages can be told apart from local problems
+report_upstream_status() {
+	reachable=true
+	echo "Checking upstream status:"
+	for url in "$@"; do
+		if http -q --spider --timeout=10 --tries=1 "${url}"; then
+			echo "  ${url}: up"
+		else
+			echo "  ${url}: down"
+			reachable=false
+		fi
+	done
+
+	if [[ "${reachable}" == true ]]; then
+		echo "Upstream appears to be up; the problem is likely local to this machine or network."
+	else
+		echo "Upstream appears to be down or unreachable from this network; try again later."
+	fi
+}
+
+# Ask for a value, printing the answer or the default when none is given
+ask() {
+	if [[ "${non_interactive}" == true ]]; then
+		echo "$2"
+		return
+	fi
+
+	read -r -p "$1 [$2]: " answer
+	echo "${answer:-$2}"
+}
+
+# Ask a yes/no question, succeeding only when the answer is yes. The answer defaults to no,
+# or to yes when the second argument is true.
+confirm() {
+	choices="[y/N]"
+	if [[ "${2:-false}" == true ]]; then
+		choices="[Y/n]"
+	fi
+
+	if [[ "${assume_yes}" == true ]]; then
+		echo "$1 ${choices} y (--yes)"
+		return 0
+	fi
+	if [[ "${non_interactive}" == true ]]; then
+		if [[ "${2:-false}" == true ]]; then
+			echo "$1 ${choices} Y (non-interactive)"
+			return 0
+		fi
+		echo "$1 ${choices} N (non-interactive)"
+		return 1
+	fi
+
+	read -r -p "$1 ${choices} " answer
+	if [[ -z "${answer}" ]]; then
+		[[ "${2:-false}" == true ]]
+		return
+	fi
+	[[ "${answer}" == [yY] || "${answer}" == [yY][eE][sS] ]]
+}
+
+# Make sure the tools needed by the selected install steps are available
+check_dependencies() {
+	required=(wget jq)
+	if [[ "${install_zig}" == true ]]; then
+		required+=(tar xz sha256sum)
+		# Exact versions and URLs may not be in the index, leaving the signature as their only check.
+		if [[ -n "${zig_version_request}" || -n "${versions_file}" ]]; then
+			required+=(minisign)
+		fi
+		if [[ -n "${cosign_key}" ]]; then
+			required+=(cosign)
+		fi
+	fi
+	if [[ "${install_zls}" == true ]]; then
+		required+=(git)
+		if [[ "${zls_prebuilt}" == true ]]; then
+			required+=(tar xz sha256sum)
+		fi
+	fi
+
+	missing=()
+	for tool in "${required[@]}"; do
+		if ! command -v "${tool}" >/dev/null && [[ " ${missing[*]} " != *" ${tool} "* ]]; then
+			missing+=("${tool}")
+		fi
+	done
+
+	if [[ "${#missing[@]}" -eq 0 ]]; then
+		return 0
+	fi
+
+	error "Missing required tools: ${missing[*]}."
+	install_command=$(package_install_command "${missing[@]}")
+	if [[ -z "${install_command}" ]]; then
+		echo "Install them with your package manager, or use --skip-deps-check."
+		exit "${EXIT_MISSING_DEPENDENCY}"
+	fi
+
+	echo "Install them with: ${install_command}"
+	if ! confirm "Run this command now?"; then
+		exit "${EXIT_MISSING_DEPENDENCY}"
+	fi
+	# shellcheck disable=SC2086 # the command is built from fixed package manager and package names
+	if ! run ${install_command}; then
+		error "Installing ${missing[*]} failed."
+		exit "${EXIT_MISSING_DEPENDENCY}"
+	fi
+}
+
+# Refuse to run anywhere but x86_64 Linux, the only platform the downloaded builds are for
+check_platform() {
+	platform="$(uname -s) $(uname -m)"
+	if [[ "${platform}" != "Linux x86_64" ]]; then
+		error "Unsupported platform: ${platform}. Only x86_64 Linux builds of Zig and ZLS are installed."
+		exit "${EXIT_UNSUPPORTED_PLATFORM}"
+	fi
+}
+
+# Print the command that installs the given tools with the detected package manager, if any
+package_install_command() {
+	root=$(escalation_tool)
+	if command -v apt-get >/dev/null; then
+		manager="${root:+${root} }apt-get install -y"
+	elif command -v dnf >/dev/null; then
+		manager="${root:+${root} }dnf install -y"
+	elif command -v pacman >/dev/null; then
+		manager="${root:+${root} }pacman -S --needed"
+	elif command -v zypper >/dev/null; then
+		manager="${root:+${root} }zypper install -y"
+	elif command -v apk >/dev/null; then
+		manager="${root:+${root} }apk add"
+	else
+		return 0
+	fi
+
+	packages=()
+	for tool in "$@"; do
+		case "${tool}" in
+		xz)
+			if [[ "${manager}" == *apt-get* ]]; then
+				packages+=(xz-utils)
+			else
+				packages+=(xz)
+			fi
+			;;
+		sha256sum) packages+=(coreutils) ;;
+		*) packages+=("${tool}") ;;
+		esac
+	done
+	echo "${manager} ${packages[*]}"
+}
+
+# Refuse to place executable links in a location other users could tamper with
+check_bin_dir() {
+	resolved_bin_dir=$(readlink -f "${bin_dir}")
+	location="${bin_dir}"
+	if [[ "${resolved_bin_dir}" != "${bin_dir}" ]]; then
+		location="${bin_dir} (-> ${resolved_bin_dir})"
+	fi
+
+	if [[ ! -d "${resolved_bin_dir}" ]]; then
+		error "${location} is not a directory."
+		exit "${EXIT_UNSAFE_BIN_DIR}"
+	fi
+
+	owner=$(stat -c %u "${resolved_bin_dir}")
+	if [[ -n "$(find "${resolved_bin_dir}" -maxdepth 0 -perm -o+w)" ]]; then
+		problem="is world-writable"
+	elif [[ "${owner}" -ne 0 && "${owner}" -ne "$(id -u)" ]]; then
+		problem="is owned by $(stat -c %U "${resolved_bin_dir}")"
+	else
+		return 0
+	fi
+
+	if [[ "${allow_unsafe_bin_dir}" == true ]]; then
+		warn "${location} ${problem}; creating links anyway."
+		return
+	fi
+
+	error "Refusing to create links in ${location}: it ${problem}."
+	echo "Use --allow-unsafe-bin-dir to override."
+	exit "${EXIT_UNSAFE_BIN_DIR}"
+}
+
+# Let editor daemons and LSP supervisors know the toolchain changed
+notify_toolchain_changed() {
+	tool=$1
+	version=$2
+
+	mkdir -p "${state_dir}"
+	echo "${tool} ${version}" >"${state_dir}/toolchain-changed"
+
+	if [[ -n "${on_change_command}" ]]; then
+		# A hook that starts a daemon must not keep the run lock held after the installer exits.
+		if ! ZIG_INSTALL_TOOL="${tool}" ZIG_INSTALL_VERSION="${version}" sh -c "${on_change_command}" 9>&-; then
+			warn "ZIG_INSTALL_ON_CHANGE command failed."
+		fi
+	fi
 }
 
 zig_install() {
-	version=$(wget -qO- https://ziglang.org/download/index.json | jq -r '.master.version')
+	start_group "Install Zig"
+	resolve_zig_version
+	install_zig_version "${version}"
+	end_group
+}
+
+# Look up the latest Zig version in the download index
+resolve_zig_version() {
+	if [[ -z "${index}" ]]; then
+		index=$(http -qO- "${zig_index_url}")
+	fi
+	if [[ -n "${zig_version_request}" ]]; then
+		resolve_requested_version
+		return
+	fi
+
+	version=$(jq -r --arg key "${index_key}" '.[$key].version // empty' <<<"${index}" 2>/dev/null)
 
 	if [[ -z "${version}" ]]; then
-		echo "Could not determine latest Zig version."
-		exit 1
+		error "Could not determine latest Zig version."
+		report_upstream_status "${zig_index_url}"
+		exit "${EXIT_DOWNLOAD_FAILED}"
+	else
+		if [[ "${channel}" == mach ]]; then
+			info "Found Mach-nominated Zig version: ${version}"
+		else
+			info "Found latest Zig version: ${version}"
+		fi
+	fi
+	zig_tarball_url="${zig_builds_url}/zig-linux-x86_64-${version}.tar.xz"
+}
+
+# Turn --version, an exact Zig version or a tarball URL, into a version and its download URL
+resolve_requested_version() {
+	if [[ "${zig_version_request}" == *://* ]]; then
+		zig_tarball_url=${zig_version_request}
+		version=${zig_tarball_url##*/zig-linux-x86_64-}
+		version=${version%.tar.xz}
+		if [[ "${zig_tarball_url##*/}" != "zig-linux-x86_64-${version}.tar.xz" ]]; then
+			error "${zig_tarball_url} does not name a zig-linux-x86_64-<version>.tar.xz tarball."
+			exit "${EXIT_USAGE}"
+		fi
 	else
-		echo "Found latest Zig version: ${version}"
+		version=${zig_version_request}
+		zig_tarball_url="${zig_builds_url}/zig-linux-x86_64-${version}.tar.xz"
+	fi
+
+	# Versions listed in the index get their size and checksum verified; older dev builds are only signed.
+	channel_key=${index_key}
+	index_key=""
+	if [[ "$(jq -r --arg key "${channel_key}" '.[$key].version // empty' <<<"${index}" 2>/dev/null)" == "${version}" ]]; then
+		index_key=${channel_key}
+	elif [[ "$(jq -r --arg key "${version}" 'has($key)' <<<"${index}" 2>/dev/null)" == true ]]; then
+		index_key=${version}
+		# Releases live in their own download directory rather than under builds.
+		if [[ "${zig_version_request}" != *://* ]]; then
+			zig_tarball_url=$(jq -r --arg key "${version}" '.[$key]."x86_64-linux".tarball // empty' <<<"${index}")
+			zig_tarball_url=${zig_tarball_url:-${zig_builds_url}/zig-linux-x86_64-${version}.tar.xz}
+		fi
 	fi
+	info "Using requested Zig version: ${version}"
+}
+
+install_zig_version() {
+	version=$1
 
-	check_version "${version}"
-	download_version "${version}"
-	cleanup_old_installations
+	if [[ "${link_zig}" == true ]] && ! check_version "${version}"; then
+		return 0
+	fi
+	if [[ -x "${zig_dir}/zig-linux-x86_64-${version}/zig" ]]; then
+		info "Zig ${version} is already downloaded."
+	else
+		download_version "${version}"
+	fi
+	if [[ "${with_src}" == true ]]; then
+		download_source "${version}"
+	fi
+	if [[ "${link_zig}" != true ]]; then
+		info "Zig ${version} is installed in ${zig_dir}/zig-linux-x86_64-${version}."
+		return 0
+	fi
+	if [[ "${no_symlink}" != true ]]; then
+		cleanup_old_installations
+	fi
 	install_version "${version}"
 }
 
+# Install every version listed in the versions file, one per line; the first one ends up linked
+install_versions_file() {
+	mapfile -t requests < <(sed -e 's/#.*//' -e 's/[[:space:]]//g' "${versions_file}" | grep -v '^$')
+	if [[ "${#requests[@]}" -eq 0 ]]; then
+		error "${versions_file} lists no Zig versions."
+		exit "${EXIT_USAGE}"
+	fi
+
+	# Resolving a version narrows index_key to that version's entry, so start each one from the channel.
+	versions_channel_key=${index_key}
+	link_zig=false
+	for request in "${requests[@]:1}"; do
+		zig_version_request=${request}
+		index_key=${versions_channel_key}
+		resolve_zig_version
+		install_zig_version "${version}"
+	done
+
+	link_zig=true
+	zig_version_request=${requests[0]}
+	index_key=${versions_channel_key}
+	resolve_zig_version
+	install_zig_version "${version}"
+}
+
 check_version() {
 	version=$1
+	if [[ "${no_symlink}" == true ]]; then
+		current=$("${zig_dir}/zig-linux-x86_64-${version}/zig" version 2>/dev/null)
+	else
+		current=$("$(zig_path)" version 2>/dev/null)
+	fi
 
-	if [[ "${version}" == "$(zig version)" ]]; then
-		echo "Zig ${version} is already installed."
-		exit 0
+	if [[ "${version}" == "${current}" ]]; then
+		info "Zig ${version} is already installed."
+		installed_zig_version=${version}
+		if [[ "${no_symlink}" == true ]]; then
+			installed_bin_dirs+=("$(dirname "$(zig_path)")")
+		fi
+		if [[ "${with_src}" == true ]]; then
+			download_source "${version}"
+		fi
+		return 1
 	fi
 }
 
 download_version() {
 	version=$1
 
-	if [[ ! -d /opt/zig ]]; then
-		sudo mkdir -p /opt/zig
-		sudo chown -R "$(whoami)":"$(whoami)" /opt/zig
-	fi
+	make_owned_dir "${zig_dir}"
 
-	if wget -q --spider "https://ziglang.org/builds/zig-linux-x86_64-${version}.tar.xz"; then
-		echo "Downloading Zig version: ${version}"
-		wget -P /opt/zig/ "https://ziglang.org/builds/zig-linux-x86_64-${version}.tar.xz"
+	cleanup_leftover_downloads
+
+	tarball="${scratch_dir}/zig-linux-x86_64-${version}.tar.xz"
+	kept_tarball="${cache_dir}/tarballs/zig-linux-x86_64-${version}.tar.xz"
+	if [[ -f "${kept_tarball}" ]]; then
+		info "Using kept tarball ${kept_tarball}."
+		cp "${kept_tarball}" "${tarball}"
+		download_status=$?
+		# Signatures kept beside the tarball let it be verified again without a network
+		for signature in "${kept_tarball}.minisig" "${kept_tarball}.sig"; do
+			if [[ -f "${signature}" ]]; then
+				cp "${signature}" "${scratch_dir}/"
+			fi
+		done
+	elif http -q --spider "${zig_tarball_url}"; then
+		confirm_download_size
+		info "Downloading Zig version: ${version}"
+		http "${download_flags[@]}" -P "${scratch_dir}" "${zig_tarball_url}"
+		download_status=$?
 	else
-		echo "Zig version ${version} not found."
-		exit 1
+		error "Zig version ${version} not found."
+		report_upstream_status "${zig_index_url}" "${zig_tarball_url}"
+		exit "${EXIT_VERSION_NOT_FOUND}"
 	fi
 
-	if [[ -f "/opt/zig/zig-linux-x86_64-${version}.tar.xz" ]]; then
-		tar -xf "/opt/zig/zig-linux-x86_64-${version}.tar.xz" -C "/opt/zig/"
-		rm "/opt/zig/zig-linux-x86_64-${version}.tar.xz"
-	else
-		echo "Zig download failed."
-		exit 1
+	if [[ "${download_status}" -ne 0 || ! -f "${tarball}" ]]; then
+		error "Zig download failed."
+		report_upstream_status "${zig_index_url}" "${zig_tarball_url}"
+		exit "${EXIT_DOWNLOAD_FAILED}"
+	fi
+
+	check_download_size "${tarball}" "$(jq -r --arg key "${index_key}" '.[$key]."x86_64-linux".size // empty' <<<"${index}" 2>/dev/null)"
+	shasum=$(jq -r --arg key "${index_key}" '.[$key]."x86_64-linux".shasum // empty' <<<"${index}" 2>/dev/null)
+	if [[ -n "${shasum}" && "$(sha256sum "${tarball}" | cut -d ' ' -f 1)" != "${shasum}" ]]; then
+		error "Checksum mismatch for ${zig_tarball_url}; refusing to install it."
+		exit "${EXIT_VERIFICATION_FAILED}"
+	elif [[ -z "${shasum}" ]] && ! command -v minisign >/dev/null; then
+		error "${zig_tarball_url} has no checksum in the index and minisign is not installed to check its signature; refusing to install it."
+		exit "${EXIT_VERIFICATION_FAILED}"
+	fi
+	verify_minisign_signature "${tarball}" "${zig_tarball_url}" "${zig_public_key}" Zig
+	verify_cosign_signature "${tarball}" "${zig_tarball_url}"
+	extract_version "${version}"
+
+	if [[ "${keep_tarball}" == true && ! -f "${kept_tarball}" ]]; then
+		mkdir -p "${cache_dir}/tarballs"
+		cp "${tarball}" "${kept_tarball}"
+		for signature in "${tarball}.minisig" "${tarball}.sig"; do
+			if [[ -f "${signature}" ]]; then
+				cp "${signature}" "${cache_dir}/tarballs/"
+			fi
+		done
+		info "Kept the tarball in ${kept_tarball}."
+	fi
+}
+
+# Download, verify and extract the Zig source tarball into the version directory
+download_source() {
+	version=$1
+	target="${zig_dir}/zig-linux-x86_64-${version}/src"
+
+	if [[ -d "${target}" ]]; then
+		info "Zig ${version} source is already installed."
+		return
+	fi
+
+	url=$(jq -r --arg key "${index_key}" '.[$key].src.tarball // empty' <<<"${index}")
+	shasum=$(jq -r --arg key "${index_key}" '.[$key].src.shasum // empty' <<<"${index}")
+	if [[ -z "${url}" ]]; then
+		error "No source tarball is listed for Zig ${version}."
+		exit "${EXIT_VERSION_NOT_FOUND}"
+	fi
+
+	info "Downloading Zig ${version} source."
+	tarball="${scratch_dir}/${url##*/}"
+	if ! http "${download_flags[@]}" -O "${tarball}" "${url}"; then
+		error "Zig source download failed."
+		report_upstream_status "${zig_index_url}" "${url}"
+		exit "${EXIT_DOWNLOAD_FAILED}"
+	fi
+
+	check_download_size "${tarball}" "$(jq -r --arg key "${index_key}" '.[$key].src.size // empty' <<<"${index}")"
+	if [[ -n "${shasum}" && "$(sha256sum "${tarball}" | cut -d ' ' -f 1)" != "${shasum}" ]]; then
+		error "Checksum mismatch for ${url}; refusing to install it."
+		exit "${EXIT_VERIFICATION_FAILED}"
+	fi
+	verify_cosign_signature "${tarball}" "${url}"
+
+	mkdir -p "${target}"
+	if ! run tar -xf "${tarball}" -C "${target}" --strip-components=1; then
+		rm -rf "${target}"
+		error "Zig source extraction failed."
+		exit "${EXIT_ERROR}"
+	fi
+	info "Zig ${version} source installed to ${target}."
+}
+
+extract_version() {
+	version=$1
+	tarball="${scratch_dir}/zig-linux-x86_64-${version}.tar.xz"
+
+	# With --verbose, the output also holds run's trace lines, which are shown with any error.
+	if tar_output=$(run tar -xf "${tarball}" -C "${zig_dir}/" 2>&1); then
+		return
+	fi
+
+	# Never leave a half-written version directory behind.
+	rm -rf "${zig_dir}/zig-linux-x86_64-${version}"
+
+	if [[ "${tar_output}" == *"No space left on device"* || "${tar_output}" == *"Disk quota exceeded"* ]]; then
+		needed=$(xz --robot --list "${tarball}" | awk '$1 == "totals" { print $5 }')
+		available=$(df -B1 --output=avail "${zig_dir}" | tail -n 1)
+		error "Not enough disk space to extract Zig ${version}."
+		echo "Needed: $(numfmt --to=iec "${needed}"), available: $(numfmt --to=iec "${available}")."
+		suggest_cleanup_targets
+		exit "${EXIT_NO_SPACE}"
+	fi
+
+	error "Zig extraction failed:" "${tar_output}"
+	exit "${EXIT_ERROR}"
+}
+
+suggest_cleanup_targets() {
+	current=$(readlink -f "$(zig_path)")
+	targets=()
+	for dir in "${zig_dir}"/zig-linux-x86_64-*/; do
+		dir=${dir%/}
+		if [[ -d "${dir}" && "${current}" != "${dir}/"* ]]; then
+			targets+=("${dir}")
+		fi
+	done
+
+	global_cache=$(zig_global_cache_dir)
+	if [[ -d "${global_cache}" ]]; then
+		echo "Zig's global cache in ${global_cache} uses $(du -sh "${global_cache}" | cut -f 1); $0 --clear-zig-cache removes it."
+	fi
+
+	if [[ "${#targets[@]}" -eq 0 ]]; then
+		echo "No old Zig versions to remove; free up space on $(df --output=target "${zig_dir}" | tail -n 1) and try again."
+		return
+	fi
+
+	echo "Consider removing old Zig versions:"
+	du -sh "${targets[@]}" | sort -rh | sed 's/^/  /'
+}
+
+# Print the directory Zig keeps its global build cache in
+zig_global_cache_dir() {
+	echo "${ZIG_GLOBAL_CACHE_DIR:-${XDG_CACHE_HOME:-$HOME/.cache}/zig}"
+}
+
+# Remove Zig's global build cache after warning about the cost of rebuilding
+clear_global_cache() {
+	global_cache=$(zig_global_cache_dir)
+	if [[ ! -d "${global_cache}" ]]; then
+		info "Zig's global cache ${global_cache} does not exist."
+		return
+	fi
+
+	echo "Zig's global cache in ${global_cache} uses $(du -sh "${global_cache}" | cut -f 1)."
+	echo "Every project will rebuild its dependencies and the standard library from scratch afterwards."
+	if ! confirm "Remove it?"; then
+		info "Zig's global cache was kept."
+		return
+	fi
+	rm -rf "${global_cache}"
+	info "Removed Zig's global cache in ${global_cache}."
+}
+
+# Offer to remove tarballs, signatures and partial downloads left behind by failed installs
+cleanup_leftover_downloads() {
+	mapfile -t leftovers < <(find "${zig_dir}" -maxdepth 1 -type f \( -name 'zig-linux-x86_64-*.tar.xz*' -o -name '*.minisig' \))
+	if [[ "${#leftovers[@]}" -eq 0 ]]; then
+		return 0
+	fi
+
+	echo "Found leftover files from previous installs:"
+	du -sh "${leftovers[@]}" | sed 's/^/  /'
+	if confirm "Remove them?"; then
+		rm -f "${leftovers[@]}"
+		echo "Removed ${#leftovers[@]} leftover file(s)."
 	fi
 }
 
 cleanup_old_installations() {
-	if [[ -f /usr/local/bin/zig ]]; then
-		echo "Removing old Zig version $(zig version)."
-		sudo rm /usr/local/bin/zig
+	if [[ -f "${bin_dir}/zig" ]]; then
+		info "Removing old Zig version $("$(zig_path)" version)."
+		privileged "${bin_dir}/zig" rm "${bin_dir}/zig"
+	elif [[ -L "${bin_dir}/zig" ]]; then
+		info "Removing broken Zig link."
+		privileged "${bin_dir}/zig" rm "${bin_dir}/zig"
+	fi
+}
+
+# Detect zig/zls links whose target was deleted and offer to repoint them
+repair_broken_links() {
+	if [[ -L "${bin_dir}/zig" && ! -e "${bin_dir}/zig" ]]; then
+		echo "${bin_dir}/zig points to $(readlink "${bin_dir}/zig"), which no longer exists."
+		newest=$(find "${zig_dir}" -mindepth 1 -maxdepth 1 -type d -name 'zig-linux-x86_64-*' 2>/dev/null | sort -V | tail -n 1)
+		if [[ -z "${newest}" ]]; then
+			echo "No installed Zig versions found to repoint it to."
+		elif confirm "Repoint it to ${newest}/zig?"; then
+			privileged "${bin_dir}/zig" ln -sfn "${newest}/zig" "${bin_dir}/zig"
+			info "Zig link now points to ${newest}/zig."
+		fi
+	fi
+
+	if [[ -L "${bin_dir}/zls" && ! -e "${bin_dir}/zls" ]]; then
+		echo "${bin_dir}/zls points to $(readlink "${bin_dir}/zls"), which no longer exists."
+		echo "Run $0 --zls-only to rebuild ZLS."
 	fi
 }
 
 install_version() {
 	version=$1
 
-	echo "Installing Zig version: ${version}"
-	sudo ln -s "/opt/zig/zig-linux-x86_64-${version}/zig" /usr/local/bin/zig
+	if [[ "${no_symlink}" == true ]]; then
+		installed_bin_dirs+=("${zig_dir}/zig-linux-x86_64-${version}")
+		installed_zig_version=${version}
+		info "Zig ${version} installed successfully."
+		notify_toolchain_changed zig "${version}"
+		return
+	fi
+
+	info "Installing Zig version: ${version}"
+	privileged "${bin_dir}/zig" ln -s "${zig_dir}/zig-linux-x86_64-${version}/zig" "${bin_dir}/zig"
 
-	if [[ -f /usr/local/bin/zig ]]; then
-		echo "Zig $(zig version) installed successfully."
+	if [[ -f "${bin_dir}/zig" ]]; then
+		installed_zig_version=${version}
+		info "Zig $("$(zig_path)" version) installed successfully."
+		notify_toolchain_changed zig "${version}"
 	else
-		echo "Zig installation failed."
-		exit 1
+		error "Zig installation failed."
+		exit "${EXIT_ERROR}"
 	fi
 }
 
 zls_install() {
-	fetch_zls
+	start_group "Install ZLS"
+	acquire_zls "$("$(zig_path)" version 2>/dev/null)"
+	finish_zls
+	end_group
+}
+
+# Install Zig while ZLS is fetched in the background; only the ZLS build waits for Zig
+install_zig_and_zls() {
+	start_group "Install Zig"
+	resolve_zig_version
+
+	# Anything that may prompt for a password has to happen in the foreground.
+	make_owned_dir "${zls_dir}"
+	if [[ "${zls_prebuilt}" == true ]]; then
+		make_owned_dir "${zls_prebuilt_dir}"
+	fi
+	info "Fetching ZLS in the background."
+	acquire_zls "${version}" </dev/null >"${scratch_dir}/zls-fetch.log" 2>"${scratch_dir}/zls-fetch.err" &
+	zls_job=$!
+
+	install_zig_version "${version}"
+	end_group
+
+	start_group "Install ZLS"
+	wait "${zls_job}"
+	zls_code=$?
+	zls_job=""
+	# Replay each stream where it would have gone, so --progress json events stay on stderr.
+	cat "${scratch_dir}/zls-fetch.log"
+	cat "${scratch_dir}/zls-fetch.err" >&2
+	if [[ "${zls_code}" -ne 0 ]]; then
+		exit "${zls_code}"
+	fi
+	finish_zls
+	end_group
+}
+
+# Start a collapsible log group in GitHub Actions
+start_group() {
+	if [[ "${github_output}" == true ]]; then
+		echo "::group::$1"
+	fi
+}
+
+# End the log group started by start_group
+end_group() {
+	if [[ "${github_output}" == true ]]; then
+		echo "::endgroup::"
+	fi
+}
+
+# Hand the Zig installed by this run to later GitHub Actions steps through GITHUB_PATH and
+# GITHUB_OUTPUT, falling back to the linked Zig when this run installed none (--zls-only)
+write_github_output() {
+	zig_version=${installed_zig_version}
+	if [[ -z "${zig_version}" ]]; then
+		zig_version=$("$(zig_path)" version 2>/dev/null)
+	fi
+	if [[ "${#installed_bin_dirs[@]}" -gt 0 ]]; then
+		printf '%s\n' "${installed_bin_dirs[@]}" >>"${GITHUB_PATH}"
+	else
+		echo "${bin_dir}" >>"${GITHUB_PATH}"
+	fi
+	{
+		echo "version=${zig_version}"
+		if [[ -n "${zig_version}" ]]; then
+			echo "path=${zig_dir}/zig-linux-x86_64-${zig_version}"
+		fi
+	} >>"${GITHUB_OUTPUT}"
+}
+
+# Get ZLS ready for the given Zig version: download the prebuilt release, or fetch and check out
+# the matching source. Linking happens in finish_zls, as this may run in the background.
+acquire_zls() {
+	zig_version=$1
+
+	if [[ "${zls_prebuilt}" == true && -n "${zls_version_override}" ]]; then
+		info "Prebuilt ZLS is selected by Zig version; building ZLS ${zls_version_override} from source."
+	elif [[ "${zls_prebuilt}" == true ]] && download_prebuilt_zls "${zig_version}"; then
+		return
+	fi
+	fetch_zls "${zig_version}"
+}
+
+# Link the ZLS prepared by acquire_zls, building it first when it came from source
+finish_zls() {
+	if [[ -f "${scratch_dir}/zls-prebuilt" ]]; then
+		read -r binary zls_version <"${scratch_dir}/zls-prebuilt"
+		install_zls "${binary}"
+		notify_toolchain_changed zls "${zls_version}"
+		return
+	fi
+
 	build_zls
-	install_zls
+	install_zls "${zls_dir}/zig-out/bin/zls"
+	notify_toolchain_changed zls "$("${zls_dir}/zig-out/bin/zls" --version)"
 }
 
-fetch_zls() {
+# Download the prebuilt ZLS release matching the given Zig; fails when the source build should be used instead
+download_prebuilt_zls() {
+	zig_version=$1
+	if [[ -z "${zig_version}" ]]; then
+		echo "Zig must be installed to select a prebuilt ZLS; falling back to building from source."
+		return 1
+	fi
+
+	release=$(http -qO- "${zls_release_url}?zig_version=${zig_version}&compatibility=only-runtime")
+	zls_version=$(jq -r '.version // empty' <<<"${release}" 2>/dev/null)
+	tarball_url=$(jq -r '."x86_64-linux".tarball // empty' <<<"${release}" 2>/dev/null)
+	shasum=$(jq -r '."x86_64-linux".shasum // empty' <<<"${release}" 2>/dev/null)
+	if [[ -z "${zls_version}" || -z "${tarball_url}" || -z "${shasum}" ]]; then
+		reason=$(jq -r '.message // empty' <<<"${release}" 2>/dev/null)
+		echo "No prebuilt ZLS available for Zig ${zig_version}${reason:+ (${reason})}; falling back to building from source."
+		return 1
+	fi
+
+	target="${zls_prebuilt_dir}/${zls_version}"
+	if [[ ! -x "${target}/zls" ]]; then
+		info "Downloading prebuilt ZLS ${zls_version}."
+		tarball="${scratch_dir}/${tarball_url##*/}"
+		if ! http "${download_flags[@]}" -O "${tarball}" "${tarball_url}"; then
+			echo "Prebuilt ZLS download failed; falling back to building from source."
+			return 1
+		fi
+
+		if [[ "$(sha256sum "${tarball}" | cut -d ' ' -f 1)" != "${shasum}" ]]; then
+			error "Checksum mismatch for ${tarball_url}; refusing to install it."
+			exit "${EXIT_VERIFICATION_FAILED}"
+		fi
+		verify_minisign_signature "${tarball}" "${tarball_url}" "${zls_public_key}" "prebuilt ZLS"
+
+		make_owned_dir "${zls_prebuilt_dir}"
+		mkdir -p "${target}"
+		if ! run tar -xf "${tarball}" -C "${target}"; then
+			rm -rf "${target}"
+			echo "Prebuilt ZLS extraction failed; falling back to building from source."
+			return 1
+		fi
 
-	if [[ -d /opt/zls ]]; then
-		cd /opt/zls || exit 1
-		git fetch
-		if [[ $(git rev-list HEAD...origin/master --count) -gt 0 ]]; then
-			echo "Fetching latest"
-			git pull
+		binary=$(find "${target}" -type f -name zls | head -n 1)
+		if [[ -z "${binary}" ]]; then
+			rm -rf "${target}"
+			echo "Prebuilt ZLS archive contains no zls binary; falling back to building from source."
+			return 1
+		elif [[ "${binary}" != "${target}/zls" ]]; then
+			ln -sfn "${binary}" "${target}/zls"
 		fi
+	fi
+
+	echo "${target}/zls ${zls_version}" >"${scratch_dir}/zls-prebuilt"
+}
+
+fetch_zls() {
+	zig_version=$1
+
+	if [[ -d "${zls_dir}/.git" ]]; then
+		cd "${zls_dir}" || exit 1
+		run_with_timeout "${git_timeout}" git fetch --tags "${quiet_flag[@]}" origin || exit "${EXIT_DOWNLOAD_FAILED}"
+	else
+		info "Fetching ZLS."
+		# A treeless clone only downloads commit history; files are fetched for the checked-out commit alone.
+		make_owned_dir "${zls_dir}"
+		run_with_timeout "${git_timeout}" git clone "${quiet_flag[@]}" --filter=tree:0 --no-checkout "${zls_repo_url}" "${zls_dir}" || exit "${EXIT_DOWNLOAD_FAILED}"
+		cd "${zls_dir}" || exit 1
+	fi
+
+	# ZLS master frequently lags or leads Zig master, so ask zigtools which ZLS builds with this Zig.
+	if [[ -n "${zls_version_override}" ]]; then
+		info "Using requested ZLS ${zls_version_override}."
+		ref="${zls_version_override}"
 	else
-		echo "Fetching ZLS."
-		sudo mkdir -p /opt/zls
-		sudo chown -R "$(whoami)":"$(whoami)" /opt/zls
-		git clone https://github.com/zigtools/zls.git /opt/zls
+		zls_version=$(http -qO- "${zls_release_url}?zig_version=${zig_version}&compatibility=full" | jq -r '.version // empty' 2>/dev/null)
+		if [[ -z "${zls_version}" ]]; then
+			info "No ZLS release matches Zig ${zig_version:-(not installed)}; using ZLS master."
+			ref="origin/master"
+		else
+			info "Using ZLS ${zls_version}, which matches Zig ${zig_version}."
+			# Dev builds are identified by the commit after the "+", releases by their tag.
+			ref="${zls_version##*+}"
+		fi
+	fi
+
+	if ! run git checkout -q --detach "${ref}"; then
+		error "ZLS ${ref} not found in the repository."
+		exit "${EXIT_VERSION_NOT_FOUND}"
 	fi
 }
 
 build_zls() {
-	echo "Building ZLS."
-	cd /opt/zls || exit 1
-	zig build -Doptimize=ReleaseSafe
+	info "Building ZLS."
+	cd "${zls_dir}" || exit 1
+	if [[ "${quiet}" != true ]]; then
+		run_with_timeout "${build_timeout}" "$(zig_path)" build -Doptimize=ReleaseSafe || exit "${EXIT_BUILD_FAILED}"
+	elif ! run_with_timeout "${build_timeout}" "$(zig_path)" build -Doptimize=ReleaseSafe >"${scratch_dir}/zls-build.log" 2>&1; then
+		cat "${scratch_dir}/zls-build.log"
+		exit "${EXIT_BUILD_FAILED}"
+	fi
+}
+
+# Show the tarball size from the index and let an interactive user back out before downloading
+confirm_download_size() {
+	size=$(jq -r --arg key "${index_key}" '.[$key]."x86_64-linux".size // empty' <<<"${index}" 2>/dev/null)
+	if [[ -z "${size}" ]]; then
+		return 0
+	fi
+
+	message="The Zig ${version} download is $(numfmt --to=iec --suffix=B "${size}")."
+	# Unattended runs go ahead, as they did before the size was shown.
+	if [[ "${non_interactive}" == true && "${assume_yes}" != true ]]; then
+		info "${message}"
+		return 0
+	fi
+	if ! confirm "${message} Download it?"; then
+		info "Installation cancelled."
+		exit 0
+	fi
+}
+
+# Compare a downloaded file's length with the size listed in the download index, if any
+check_download_size() {
+	file=$1
+	expected=$2
+
+	if [[ -z "${expected}" ]]; then
+		return 0
+	fi
+	actual=$(stat -c %s "${file}")
+	if [[ "${actual}" -ne "${expected}" ]]; then
+		error "Truncated or mismatched download: ${file##*/} is ${actual} bytes, but the index lists ${expected}."
+		exit "${EXIT_DOWNLOAD_FAILED}"
+	fi
+}
+
+# Check the cosign signature published next to a Zig tarball, when a cosign key is configured.
+# A signature already beside the tarball (from a kept tarball) is used instead of downloading it.
+verify_cosign_signature() {
+	tarball=$1
+	url=$2
+
+	if [[ -z "${cosign_key}" ]]; then
+		return 0
+	fi
+
+	if [[ ! -f "${tarball}.sig" ]] && ! http -q -O "${tarball}.sig" "${url}.sig"; then
+		error "Could not download the cosign signature for ${url}; refusing to install it."
+		exit "${EXIT_VERIFICATION_FAILED}"
+	fi
+	if ! run cosign verify-blob --key "${cosign_key}" --signature "${tarball}.sig" "${tarball}"; then
+		error "cosign verification failed for ${url}; refusing to install it."
+		exit "${EXIT_VERIFICATION_FAILED}"
+	fi
+}
+
+# Check the minisign signature published next to a tarball against the given public key.
+# A signature already beside the tarball (from a kept tarball) is used instead of downloading it.
+verify_minisign_signature() {
+	tarball=$1
+	url=$2
+	public_key=$3
+	name=$4
+
+	if ! command -v minisign >/dev/null; then
+		warn "minisign is not installed; ${name} was not verified by signature."
+		return 0
+	fi
+
+	if [[ ! -f "${tarball}.minisig" ]] && ! http -q -O "${tarball}.minisig" "${url}.minisig"; then
+		error "Could not download the signature for ${url}; refusing to install it."
+		exit "${EXIT_VERIFICATION_FAILED}"
+	fi
+	if ! run minisign -V -q -P "${public_key}" -m "${tarball}"; then
+		error "Signature verification failed for ${url}; refusing to install it."
+		exit "${EXIT_VERIFICATION_FAILED}"
+	fi
 }
 
 install_zls() {
-	if [[ ! -f /usr/local/bin/zls ]]; then
-		echo "Installing ZLS."
-		sudo ln -s /opt/zls/zig-out/bin/zls /usr/local/bin/zls
+	binary=$1
+
+	mkdir -p "${state_dir}"
+	"$(zig_path)" version >"${state_dir}/zls-built-with"
+
+	if [[ "${no_symlink}" == true ]]; then
+		installed_bin_dirs+=("$(dirname "${binary}")")
+	elif [[ "$(readlink "${bin_dir}/zls")" != "${binary}" ]]; then
+		info "Installing ZLS."
+		privileged "${bin_dir}/zls" ln -sfn "${binary}" "${bin_dir}/zls"
+	fi
+}
+
+zls_status() {
+	if [[ ! -x "${bin_dir}/zls" ]]; then
+		echo "ZLS is not installed."
+		return
+	fi
+
+	zls_version=$("${bin_dir}/zls" --version)
+	zig_version=$("$(zig_path)" version 2>/dev/null)
+	built_with=$(cat "${state_dir}/zls-built-with" 2>/dev/null)
+	compatible=""
+	if [[ -n "${zig_version}" ]]; then
+		compatible=$(http -qO- "${zls_release_url}?zig_version=${zig_version}&compatibility=only-runtime" | jq -r '.version // empty' 2>/dev/null)
+	fi
+
+	echo "ZLS version:    ${zls_version}"
+	echo "Built for Zig:  ${built_with:-unknown}"
+	echo "Active Zig:     ${zig_version:-not installed}"
+	echo "Compatible ZLS: ${compatible:-unknown}"
+
+	if [[ -z "${zig_version}" ]]; then
+		echo "Install Zig with $0 --zig-only to use ZLS."
+	elif [[ -n "${compatible}" && "${compatible}" != "${zls_version}" ]]; then
+		echo "Update recommended: run $0 --zls-only to install ZLS ${compatible}."
+	elif [[ -n "${built_with}" && "${built_with}" != "${zig_version}" ]]; then
+		echo "Rebuild recommended: ZLS was built for a different Zig; run $0 --zls-only."
+	else
+		echo "ZLS is up to date."
+	fi
+}
+
+# Remove every Zig version, ZLS, the links, the download cache, state and logs, and optionally the config
+purge_all() {
+	targets=()
+	for dir in "${zig_dir}"/zig-linux-x86_64-*/ "${zls_dir}" "${zls_prebuilt_dir}"; do
+		if [[ -d "${dir}" ]]; then
+			targets+=("${dir%/}")
+		fi
+	done
+	for tool in zig zls; do
+		link_target=$(readlink "${bin_dir}/${tool}")
+		if [[ "${link_target}" == "${zig_dir}"/* || "${link_target}" == "${zls_dir}"/* || "${link_target}" == "${zls_prebuilt_dir}"/* ]]; then
+			targets+=("${bin_dir}/${tool}")
+		fi
+	done
+	for path in "${cache_dir}" "${state_dir}" "${log_file}" "${log_file}".[0-9]*; do
+		if [[ ! -e "${path}" ]]; then
+			continue
+		fi
+		# The default log file lives in the state directory, so it is already covered.
+		for target in "${targets[@]}"; do
+			if [[ "${path}" == "${target}" || "${path}" == "${target}"/* ]]; then
+				continue 2
+			fi
+		done
+		targets+=("${path}")
+	done
+	if [[ "${purge_config}" == true && -f "${config_file}" ]]; then
+		targets+=("${config_file}")
+	fi
+
+	if [[ "${#targets[@]}" -eq 0 ]]; then
+		info "Nothing to purge."
+		return
+	fi
+
+	echo "The following will be removed:"
+	printf '  %s\n' "${targets[@]}"
+	if [[ "${purge_config}" != true && -f "${config_file}" ]]; then
+		echo "${config_file} is kept; add --with-config to remove it too."
+	fi
+	if ! confirm "Remove all of this? This cannot be undone."; then
+		info "Nothing was removed."
+		return
+	fi
+
+	# Logging would recreate the log file that is being removed.
+	log_level=""
+	removal_failed=false
+	for target in "${targets[@]}"; do
+		if ! privileged "$(dirname "${target}")" rm -rf "${target}"; then
+			error "Could not remove ${target}."
+			removal_failed=true
+		fi
+	done
+	if [[ -d "${zig_dir}" && -z "$(ls -A "${zig_dir}")" ]] && ! privileged "$(dirname "${zig_dir}")" rmdir "${zig_dir}"; then
+		error "Could not remove ${zig_dir}."
+		removal_failed=true
+	fi
+	if [[ "${removal_failed}" == true ]]; then
+		exit "${EXIT_ERROR}"
+	fi
+	echo "Purged all files managed by the installer."
+}
+
+uninstall_zls() {
+	targets=()
+	for dir in "${zls_dir}" "${zls_prebuilt_dir}"; do
+		if [[ -d "${dir}" ]]; then
+			targets+=("${dir}")
+		fi
+	done
+	link_target=$(readlink "${bin_dir}/zls")
+	if [[ "${link_target}" == "${zls_dir}"/* || "${link_target}" == "${zls_prebuilt_dir}"/* ]]; then
+		targets+=("${bin_dir}/zls")
+	fi
+
+	if [[ "${#targets[@]}" -eq 0 ]]; then
+		info "ZLS is not installed."
+		return
+	fi
+
+	echo "The following will be removed:"
+	printf '  %s\n' "${targets[@]}"
+	if ! confirm "Uninstall ZLS?"; then
+		info "ZLS was not uninstalled."
+		return
+	fi
+
+	# Removing an entry takes write access to the directory that holds it.
+	removal_failed=false
+	for target in "${targets[@]}"; do
+		if ! privileged "$(dirname "${target}")" rm -rf "${target}"; then
+			error "Could not remove ${target}."
+			removal_failed=true
+		fi
+	done
+	if [[ "${removal_failed}" == true ]]; then
+		exit "${EXIT_ERROR}"
 	fi
+	info "ZLS uninstalled."
 }
 
 main() {
+	# Prompts cannot be answered from a pipe or CI job, so take their defaults instead of blocking.
+	if [[ ! -t 0 ]]; then
+		non_interactive=true
+	fi
+
+	if [[ "$1" == "config" ]]; then
+		shift
+		config_command "$@"
+		exit 0
+	elif [[ "$1" == "init" ]]; then
+		init_command
+		exit 0
+	elif [[ "$1" == "logs" ]]; then
+		shift
+		logs_command "$@"
+		exit 0
+	elif [[ "$1" == "du" ]]; then
+		shift
+		du_command "$@"
+		exit 0
+	elif [[ "$1" == "changelog" ]]; then
+		shift
+		changelog_command "$@"
+		exit 0
+	elif [[ "$1" == "env" ]]; then
+		shift
+		env_command "$@"
+		exit 0
+	elif [[ "$1" == "setup-path" ]]; then
+		shift
+		setup_path_command "$@"
+		exit 0
+	fi
+
 	cwd=$(pwd)
-	if [[ "$#" -eq 0 ]]; then
-		zig_install
-		zls_install
-	elif [[ "$1" == "--zig-only" ]]; then
+	install_zig=true
+	install_zls=true
+	uninstall=false
+	status=false
+
+	while [[ "$#" -gt 0 ]]; do
+		case "$1" in
+		--zig-only) install_zls=false ;;
+		--zls-only) install_zig=false ;;
+		--channel)
+			if [[ "$2" != master && "$2" != mach ]]; then
+				echo "--channel must be master or mach."
+				help "${EXIT_USAGE}"
+			fi
+			channel=$2
+			shift
+			;;
+		--version)
+			if [[ -z "$2" ]]; then
+				echo "--version requires a Zig version or tarball URL."
+				help "${EXIT_USAGE}"
+			fi
+			zig_version_request=$2
+			shift
+			;;
+		--from-versions-file)
+			if [[ ! -f "$2" ]]; then
+				echo "--from-versions-file requires an existing file."
+				help "${EXIT_USAGE}"
+			fi
+			versions_file=$2
+			shift
+			;;
+		--print-path) print_path=true ;;
+		--keep-tarball) keep_tarball=true ;;
+		--with-src) with_src=true ;;
+		--zls-prebuilt) zls_prebuilt=true ;;
+		--zls-version)
+			if [[ -z "$2" ]]; then
+				echo "--zls-version requires a version."
+				help "${EXIT_USAGE}"
+			fi
+			zls_version_override=$2
+			shift
+			;;
+		--zls-status) status=true ;;
+		--uninstall-zls) uninstall=true ;;
+		--purge) purge=true ;;
+		--with-config) purge_config=true ;;
+		--trace-http) trace_http=true ;;
+		--log-file)
+			if [[ -z "$2" ]]; then
+				echo "--log-file requires a path."
+				help "${EXIT_USAGE}"
+			fi
+			log_file=$2
+			shift
+			;;
+		--log-level)
+			if [[ -z "$(log_severity "$2")" ]]; then
+				echo "--log-level must be debug, info, warn or error."
+				help "${EXIT_USAGE}"
+			fi
+			log_level=$2
+			shift
+			;;
+		--console-log-level)
+			if [[ -z "$(log_severity "$2")" ]]; then
+				echo "--console-log-level must be debug, info, warn or error."
+				help "${EXIT_USAGE}"
+			fi
+			console_log_level=$2
+			shift
+			;;
+		--log-format)
+			if [[ "$2" != text && "$2" != json ]]; then
+				echo "--log-format must be text or json."
+				help "${EXIT_USAGE}"
+			fi
+			log_format=$2
+			shift
+			;;
+		--skip-deps-check) skip_deps_check=true ;;
+		--allow-unsafe-bin-dir) allow_unsafe_bin_dir=true ;;
+		--github-output)
+			if [[ -z "${GITHUB_PATH}" || -z "${GITHUB_OUTPUT}" ]]; then
+				echo "--github-output requires GITHUB_PATH and GITHUB_OUTPUT, which GitHub Actions sets."
+				help "${EXIT_USAGE}"
+			fi
+			github_output=true
+			;;
+		--progress)
+			if [[ "$2" != json ]]; then
+				echo "--progress must be json."
+				help "${EXIT_USAGE}"
+			fi
+			progress=$2
+			shift
+			;;
+		-q | --quiet) quiet=true ;;
+		-v | --verbose) verbose=true ;;
+		-y | --yes) assume_yes=true ;;
+		--non-interactive) non_interactive=true ;;
+		--wait) wait_for_lock=true ;;
+		--notify) desktop_notify=true ;;
+		--prefix)
+			if [[ -z "$2" ]]; then
+				echo "--prefix requires a directory."
+				help "${EXIT_USAGE}"
+			fi
+			# Links and the ZLS build resolve paths from other directories, so keep it absolute
+			prefix=$(realpath -m -- "$2")
+			shift
+			;;
+		--no-symlink) no_symlink=true ;;
+		--clean-temp) clean_temp=true ;;
+		--clear-zig-cache) clear_zig_cache=true ;;
+		-h | --help) help ;;
+		*)
+			echo "Invalid option: $1"
+			help "${EXIT_USAGE}"
+			;;
+		esac
+		shift
+	done
+
+	if [[ "${print_path}" == true && -n "${versions_file}" ]]; then
+		echo "--print-path cannot be combined with --from-versions-file."
+		help "${EXIT_USAGE}"
+	fi
+
+	quiet_flag=()
+	if [[ "${quiet}" == true ]]; then
+		quiet_flag=(-q)
+	fi
+	# Downloads large enough to be worth reporting progress for
+	download_flags=("${quiet_flag[@]}")
+	if [[ "${progress}" == json ]]; then
+		download_flags=(--progress-events)
+	fi
+
+	if [[ -z "${log_level}" && "${trace_http}" == true ]]; then
+		log_level=debug
+	fi
+	log_level=${log_level:-info}
+
+	load_settings
+	if [[ -n "${prefix}" ]]; then
+		zig_dir="${prefix}/zig"
+		zls_dir="${prefix}/zls"
+		zls_prebuilt_dir="${prefix}/zls-prebuilt"
+		bin_dir="${prefix}/bin"
+	fi
+	# Mach's index uses the ziglang.org schema, with its nominated version under "mach-latest".
+	if [[ "${channel}" == mach ]]; then
+		zig_index_url="${mach_index_url}"
+		zig_builds_url="${mach_builds_url}"
+		index_key=mach-latest
+	fi
+	rotate_log
+	# Without an explicit --zls-only, respect a config that opted out of managing ZLS.
+	if [[ "${manage_zls}" != true && "${install_zig}" == true ]]; then
+		install_zls=false
+	fi
+
+	if [[ "${print_path}" == true ]]; then
+		log_command=print-path
+		make_scratch_dir
+		# Only the path goes to standard output, so it can be captured directly.
+		quiet=true
+		resolve_zig_version
+		realpath -m -- "${zig_dir}/zig-linux-x86_64-${version}"
+		exit 0
+	fi
+	if [[ "${status}" == true ]]; then
+		log_command=zls-status
+		make_scratch_dir
+		zls_status
+		exit 0
+	fi
+
+	# The lock is held until the script exits, which closes its file descriptor.
+	acquire_lock
+	if [[ "${clean_temp}" == true ]]; then
+		rm -rf "${cache_dir}/tmp"
+		info "Removed temporary files in ${cache_dir}/tmp."
+		exit 0
+	fi
+	if [[ "${clear_zig_cache}" == true ]]; then
+		log_command=clear-zig-cache
+		clear_global_cache
+		exit 0
+	fi
+	if [[ "${purge}" == true ]]; then
+		log_command=purge
+		purge_all
+		exit 0
+	fi
+	make_scratch_dir
+	if [[ "${uninstall}" == true ]]; then
+		log_command=uninstall-zls
+		uninstall_zls
+		exit 0
+	fi
+
+	check_platform
+	if [[ "${skip_deps_check}" != true ]]; then
+		check_dependencies
+	fi
+	if [[ "${no_symlink}" != true ]]; then
+		if [[ -n "${prefix}" ]]; then
+			make_owned_dir "${bin_dir}"
+		fi
+		check_bin_dir
+		repair_broken_links
+	fi
+	if [[ -n "${versions_file}" && "${install_zig}" == true ]]; then
+		start_group "Install Zig"
+		install_versions_file
+		end_group
+		if [[ "${install_zls}" == true ]]; then
+			zls_install
+		fi
+	elif [[ "${install_zig}" == true && "${install_zls}" == true ]]; then
+		install_zig_and_zls
+	elif [[ "${install_zig}" == true ]]; then
 		zig_install
-	elif [[ "$1" == "--zls-only" ]]; then
+	elif [[ "${install_zls}" == true ]]; then
 		zls_install
-	elif [[ "$1" == "-h" || "$1" == "--help" ]]; then
-		help
-	else
-		echo "Invalid option: $1"
-		help
 	fi
 	cd "$cwd" || exit 1
-	echo "Done!"
+	if [[ "${github_output}" == true ]]; then
+		write_github_output
+	fi
+	if [[ "${#installed_bin_dirs[@]}" -gt 0 ]]; then
+		info "Installed without links; add these directories to PATH:"
+		(
+			IFS=:
+			echo "${installed_bin_dirs[*]}"
+		)
+	fi
+	info "Done!"
 	exit 0
 }
 